@@ -0,0 +1,73 @@
+/*
+ * Spreed WebRTC.
+ * Copyright (C) 2013-2014 struktur AG
+ *
+ * This file is part of Spreed WebRTC.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+)
+
+// BackendConfig describes one entry of the [backends] config section. Each
+// backend is a separate tenant with its own room namespace, shared secret
+// and TURN configuration, mirroring the "allowed"/"backends" mechanism of
+// the external signaling server config.
+type BackendConfig struct {
+	Id         string
+	UrlPattern string
+	Secret     []byte
+	TurnURIs   []string
+	RoomPrefix string
+}
+
+// BackendManager resolves a backend id as sent by the client in DataHello
+// to its BackendConfig and keys room ids so that rooms of different
+// backends never collide.
+type BackendManager struct {
+	backends map[string]*BackendConfig
+}
+
+func NewBackendManager(configs []*BackendConfig) *BackendManager {
+	backends := make(map[string]*BackendConfig)
+	for _, config := range configs {
+		backends[config.Id] = config
+	}
+	return &BackendManager{backends: backends}
+}
+
+// Get returns the BackendConfig for id, or false if id is not a configured
+// backend.
+func (m *BackendManager) Get(id string) (*BackendConfig, bool) {
+	if m == nil {
+		return nil, false
+	}
+	config, ok := m.backends[id]
+	return config, ok
+}
+
+// RoomKey namespaces roomId by backendId so that "abc" on backend A and
+// "abc" on backend B are distinct rooms.
+func (m *BackendManager) RoomKey(backendId, roomId string) string {
+	prefix := backendId
+	if config, ok := m.Get(backendId); ok && config.RoomPrefix != "" {
+		prefix = config.RoomPrefix
+	}
+	return fmt.Sprintf("%s/%s", prefix, roomId)
+}
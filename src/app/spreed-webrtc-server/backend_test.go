@@ -0,0 +1,49 @@
+/*
+ * Spreed WebRTC.
+ * Copyright (C) 2013-2014 struktur AG
+ *
+ * This file is part of Spreed WebRTC.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import "testing"
+
+func TestBackendManagerRoomKeyNamespacesPerBackend(t *testing.T) {
+	m := NewBackendManager([]*BackendConfig{{Id: "a"}, {Id: "b", RoomPrefix: "tenant-b"}})
+
+	if key := m.RoomKey("a", "lobby"); key != "a/lobby" {
+		t.Errorf("RoomKey(a, lobby) = %q, want %q", key, "a/lobby")
+	}
+	if key := m.RoomKey("b", "lobby"); key != "tenant-b/lobby" {
+		t.Errorf("RoomKey(b, lobby) = %q, want %q", key, "tenant-b/lobby")
+	}
+	if m.RoomKey("a", "lobby") == m.RoomKey("b", "lobby") {
+		t.Fatalf("rooms of different backends must never collide")
+	}
+}
+
+func TestBackendManagerNilReceiverIsSafe(t *testing.T) {
+	var m *BackendManager
+
+	if _, ok := m.Get("a"); ok {
+		t.Errorf("nil BackendManager.Get must report not found")
+	}
+	if key := m.RoomKey("a", "lobby"); key != "a/lobby" {
+		t.Errorf("nil BackendManager.RoomKey = %q, want %q", key, "a/lobby")
+	}
+}
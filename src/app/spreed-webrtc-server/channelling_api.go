@@ -0,0 +1,138 @@
+/*
+ * Spreed WebRTC.
+ * Copyright (C) 2013-2014 struktur AG
+ *
+ * This file is part of Spreed WebRTC.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"go.uber.org/zap"
+)
+
+// RoomStatus is the read-only subset of RoomManager the channelling API
+// uses to tell a joining client who else is already in the room, kept
+// separate from RoomManager so a caller that only needs to list room
+// members doesn't have to depend on the ability to mutate one.
+type RoomStatus interface {
+	RoomUsers(session *Session) []*DataSession
+}
+
+// ChannellingAPI handles incoming signaling messages from a single client
+// connection and turns them into the corresponding Hub/RoomManager calls.
+type ChannellingAPI interface {
+	OnIncoming(client Client, session *Session, msg *DataIncoming)
+}
+
+type channellingAPI struct {
+	version        string
+	config         *Config
+	roomManager    RoomManager
+	sessionManager SessionStore
+	hub            Hub
+	turnData       TurnDataCreator
+	contactManager ContactManager
+	clientStats    ClientStats
+	backends       *BackendManager
+	roomStatus     RoomStatus
+	logger         *zap.Logger
+}
+
+func NewChannellingAPI(version string, config *Config, roomManager RoomManager, sessionManager SessionStore, hub Hub, turnData TurnDataCreator, contactManager ContactManager, clientStats ClientStats, backends *BackendManager, roomStatus RoomStatus, logger *zap.Logger) ChannellingAPI {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	return &channellingAPI{
+		version:        version,
+		config:         config,
+		roomManager:    roomManager,
+		sessionManager: sessionManager,
+		hub:            hub,
+		turnData:       turnData,
+		contactManager: contactManager,
+		clientStats:    clientStats,
+		backends:       backends,
+		roomStatus:     roomStatus,
+		logger:         logger,
+	}
+}
+
+func (api *channellingAPI) OnIncoming(client Client, session *Session, msg *DataIncoming) {
+	switch msg.Type {
+	case "Hello":
+		api.onHello(client, session, msg.Hello)
+	case "Chat":
+		// Broadcast rate limits per message type, keyed by this same wire
+		// type string (see wireType in room.go), so a client cannot flood
+		// the room with Chat/Status/Bye regardless of how fast it sends.
+		api.roomManager.Broadcast(session, msg.Chat)
+	case "Status":
+		api.roomManager.Broadcast(session, msg.Status)
+	case "Bye":
+		api.roomManager.Broadcast(session, msg.Bye)
+	}
+}
+
+// onHello validates the requested backend and room, moves session into the
+// requested room (announcing a "soft" leave of any room it was previously
+// in first, so peers see a graceful handover rather than a hard drop) and
+// announces the session's arrival to the room's other members.
+func (api *channellingAPI) onHello(client Client, session *Session, hello *DataHello) {
+	if hello.Backend != "" {
+		if _, ok := api.backends.Get(hello.Backend); !ok {
+			api.logger.Warn("Rejected Hello for unknown backend",
+				zap.String("session_id", session.Id),
+				zap.String("room_id", hello.Id),
+				zap.String("backend", hello.Backend),
+			)
+			client.Reply("Error", &DataError{Code: "backend_unknown"})
+			return
+		}
+		if current := session.Backend(); current != "" && current != hello.Backend {
+			api.logger.Warn("Rejected Hello for mismatched backend",
+				zap.String("session_id", session.Id),
+				zap.String("room_id", hello.Id),
+				zap.String("backend", hello.Backend),
+			)
+			client.Reply("Error", &DataError{Code: "backend_mismatch"})
+			return
+		}
+		session.SetBackend(hello.Backend)
+	}
+
+	if !api.roomManager.CanJoinRoom(session.Backend(), hello.Id) {
+		client.Reply("Error", &DataError{Code: "room_full"})
+		return
+	}
+
+	if session.Roomid != "" && session.Roomid != hello.Id {
+		leaving := session.Data()
+		leaving.Status = "soft"
+		api.roomManager.Broadcast(session, leaving)
+		api.roomManager.LeaveRoom(session)
+	}
+
+	session.Roomid = hello.Id
+	session.Ua = hello.Ua
+	api.roomManager.JoinRoom(session, client)
+
+	if api.roomStatus != nil {
+		client.Reply("Users", api.roomStatus.RoomUsers(session))
+	}
+	api.roomManager.Broadcast(session, session.Data())
+}
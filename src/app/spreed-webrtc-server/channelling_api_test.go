@@ -30,12 +30,19 @@ const (
 )
 
 type fakeClient struct {
+	replies []fakeReply
+}
+
+type fakeReply struct {
+	typ  string
+	data interface{}
 }
 
 func (fake *fakeClient) Send(_ Buffer) {
 }
 
-func (fake *fakeClient) Reply(_ string, _ interface{}) {
+func (fake *fakeClient) Reply(typ string, data interface{}) {
+	fake.replies = append(fake.replies, fakeReply{typ, data})
 }
 
 type fakeRoomManager struct {
@@ -48,7 +55,7 @@ type fakeRoomManager struct {
 	broadcasts   []interface{}
 }
 
-func (fake *fakeRoomManager) CanJoinRoom(roomID string) bool {
+func (fake *fakeRoomManager) CanJoinRoom(backendId, roomID string) bool {
 	return !fake.disallowJoin
 }
 
@@ -73,6 +80,11 @@ func NewTestChannellingAPI() (ChannellingAPI, *fakeClient, *Session, *fakeRoomMa
 	return NewChannellingAPI(testAppVersion, nil, roomManager, nil, nil, nil, nil, nil, nil, roomManager, nil), client, session, roomManager
 }
 
+func NewTestChannellingAPIWithBackends(backends *BackendManager) (ChannellingAPI, *fakeClient, *Session, *fakeRoomManager) {
+	client, roomManager, session := &fakeClient{}, &fakeRoomManager{}, &Session{}
+	return NewChannellingAPI(testAppVersion, nil, roomManager, nil, nil, nil, nil, nil, backends, roomManager, nil), client, session, roomManager
+}
+
 func Test_ChannellingAPI_OnIncoming_HelloMessage_JoinsTheSelectedRoom(t *testing.T) {
 	roomID, ua := "foobar", "unit tests"
 	api, client, session, roomManager := NewTestChannellingAPI()
@@ -132,3 +144,42 @@ func Test_ChannellingAPI_OnIncoming_HelloMessage_DoesNotJoinIfNotPermitted(t *te
 		t.Fatalf("Expected no broadcasts, but got %d", broadcastCount)
 	}
 }
+
+func Test_ChannellingAPI_OnIncoming_HelloMessage_RejectsUnknownBackend(t *testing.T) {
+	backends := NewBackendManager([]*BackendConfig{{Id: "known"}})
+	api, client, session, roomManager := NewTestChannellingAPIWithBackends(backends)
+
+	api.OnIncoming(client, session, &DataIncoming{Type: "Hello", Hello: &DataHello{Id: "foobar", Backend: "unknown"}})
+
+	if roomManager.joinedID != "" {
+		t.Errorf("Expected not to have joined any room, but joined %v", roomManager.joinedID)
+	}
+	if broadcastCount := len(roomManager.broadcasts); broadcastCount != 0 {
+		t.Fatalf("Expected no broadcasts, but got %d", broadcastCount)
+	}
+	if len(client.replies) != 1 || client.replies[0].typ != "Error" {
+		t.Fatalf("Expected a single Error reply, but got %+v", client.replies)
+	}
+	if err, ok := client.replies[0].data.(*DataError); !ok || err.Code != "backend_unknown" {
+		t.Errorf("Expected DataError{Code: backend_unknown}, but got %+v", client.replies[0].data)
+	}
+}
+
+func Test_ChannellingAPI_OnIncoming_HelloMessage_JoinsKnownBackend(t *testing.T) {
+	backends := NewBackendManager([]*BackendConfig{{Id: "known"}})
+	api, client, session, roomManager := NewTestChannellingAPIWithBackends(backends)
+
+	api.OnIncoming(client, session, &DataIncoming{Type: "Hello", Hello: &DataHello{Id: "foobar", Backend: "known"}})
+
+	if roomManager.joinedID != "foobar" {
+		t.Errorf("Expected to have joined room foobar, but got %v", roomManager.joinedID)
+	}
+	if broadcastCount := len(roomManager.broadcasts); broadcastCount != 1 {
+		t.Fatalf("Expected 1 broadcast, but got %d", broadcastCount)
+	}
+	for _, reply := range client.replies {
+		if reply.typ == "Error" {
+			t.Fatalf("Expected no Error reply for a known backend, but got %+v", reply)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+/*
+ * Spreed WebRTC.
+ * Copyright (C) 2013-2014 struktur AG
+ *
+ * This file is part of Spreed WebRTC.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestClusterForwardCodecRoundTrips(t *testing.T) {
+	codec := clusterForwardCodec{}
+	want := &clusterWireMessage{Kind: "node", Target: "node-1", Payload: []byte("hello")}
+
+	data, err := codec.Marshal(want)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	got := &clusterWireMessage{}
+	if err := codec.Unmarshal(data, got); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if got.Kind != want.Kind || got.Target != want.Target || string(got.Payload) != string(want.Payload) {
+		t.Errorf("round trip = %+v, want %+v", got, want)
+	}
+	if codec.Name() != "spreed-cluster-json" {
+		t.Errorf("Name() = %q, want %q", codec.Name(), "spreed-cluster-json")
+	}
+}
+
+func TestGRPCClusterTransportDispatchRoutesToRegisteredHandler(t *testing.T) {
+	transport := &grpcClusterTransport{
+		nodeHandlers: make(map[string]func(payload []byte)),
+		roomHandlers: make(map[string]func(payload []byte)),
+	}
+
+	var nodePayload, roomPayload []byte
+	if err := transport.SubscribeNode("node-1", func(payload []byte) { nodePayload = payload }); err != nil {
+		t.Fatalf("SubscribeNode() error = %v", err)
+	}
+	if err := transport.SubscribeRoom("room-1", func(payload []byte) { roomPayload = payload }); err != nil {
+		t.Fatalf("SubscribeRoom() error = %v", err)
+	}
+
+	transport.dispatch(&clusterWireMessage{Kind: "node", Target: "node-1", Payload: []byte("to-node")})
+	transport.dispatch(&clusterWireMessage{Kind: "room", Target: "room-1", Payload: []byte("to-room")})
+	transport.dispatch(&clusterWireMessage{Kind: "node", Target: "node-2", Payload: []byte("unmatched")})
+
+	if string(nodePayload) != "to-node" {
+		t.Errorf("node handler payload = %q, want %q", nodePayload, "to-node")
+	}
+	if string(roomPayload) != "to-room" {
+		t.Errorf("room handler payload = %q, want %q", roomPayload, "to-room")
+	}
+}
+
+func TestNewClusterTransportRejectsUnknownTransport(t *testing.T) {
+	if _, err := NewClusterTransport(&ClusterConfig{Transport: "carrier-pigeon"}); err == nil {
+		t.Fatal("expected an error for an unknown cluster transport")
+	}
+}
+
+func TestNewSessionDirectoryRejectsUnknownBackend(t *testing.T) {
+	if _, err := NewSessionDirectory(&ClusterConfig{DirectoryBackend: "filing-cabinet"}); err == nil {
+		t.Fatal("expected an error for an unknown cluster directory backend")
+	}
+}
+
+// fakeSessionDirectory records Heartbeat calls so runHeartbeat can be
+// tested without a real etcd/Redis backend.
+type fakeSessionDirectory struct {
+	mutex      sync.Mutex
+	heartbeats int
+	lastNodeId string
+	lastTTL    time.Duration
+}
+
+func (f *fakeSessionDirectory) Lookup(sessionId string) (string, string, bool) { return "", "", false }
+func (f *fakeSessionDirectory) Register(sessionId, nodeId, backendId string, ttl time.Duration) error {
+	return nil
+}
+func (f *fakeSessionDirectory) Unregister(sessionId string) error { return nil }
+func (f *fakeSessionDirectory) Heartbeat(nodeId string, ttl time.Duration) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.heartbeats++
+	f.lastNodeId = nodeId
+	f.lastTTL = ttl
+	return nil
+}
+
+func TestRunHeartbeatKeepsBeatingUntilStopped(t *testing.T) {
+	directory := &fakeSessionDirectory{}
+	stop := make(chan struct{})
+
+	done := make(chan struct{})
+	go func() {
+		runHeartbeat(directory, "node-1", 5*time.Millisecond, defaultNodeTTL, stop, zap.NewNop())
+		close(done)
+	}()
+
+	time.Sleep(30 * time.Millisecond)
+	close(stop)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("runHeartbeat did not return after stop was closed")
+	}
+
+	directory.mutex.Lock()
+	defer directory.mutex.Unlock()
+	if directory.heartbeats == 0 {
+		t.Fatal("expected at least one heartbeat before stop")
+	}
+	if directory.lastNodeId != "node-1" {
+		t.Errorf("Heartbeat nodeId = %q, want %q", directory.lastNodeId, "node-1")
+	}
+	if directory.lastTTL != defaultNodeTTL {
+		t.Errorf("Heartbeat ttl = %v, want %v", directory.lastTTL, defaultNodeTTL)
+	}
+}
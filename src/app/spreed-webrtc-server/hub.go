@@ -22,17 +22,22 @@
 package main
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/hmac"
 	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/gorilla/securecookie"
-	"log"
 	"sync"
 	"time"
+
+	"github.com/gorilla/securecookie"
+	"go.uber.org/zap"
+
+	"github.com/strukturag/spreed-webrtc/src/app/spreed-webrtc-server/proxy"
 )
 
 const (
@@ -59,10 +64,24 @@ type ContactManager interface {
 
 type TurnDataCreator interface {
 	CreateTurnData(*Session) *DataTurn
+	CreateTurnRealms(*Session) []*DataTurnRealm
 }
 
 type ClientStats interface {
 	ClientInfo(details bool) (int, map[string]*DataSession, map[string]string)
+	RateLimitStats(sessionId string) map[string]*RateLimitStats
+}
+
+type RoomBroadcaster interface {
+	BroadcastRoom(session *Session, roomId, messageType string, m interface{})
+	EnsureClusterRoomSubscribed(roomId, backendId string)
+}
+
+// Logging lets callers outside the hub (such as the channelling API)
+// reuse the same structured logger the hub itself was built with, instead
+// of constructing their own and losing shared fields/sampling config.
+type Logging interface {
+	Logger() *zap.Logger
 }
 
 type Hub interface {
@@ -70,6 +89,8 @@ type Hub interface {
 	Unicaster
 	TurnDataCreator
 	ContactManager
+	RoomBroadcaster
+	Logging
 }
 
 type hub struct {
@@ -79,25 +100,281 @@ type hub struct {
 	turnSecret []byte
 	mutex      sync.RWMutex
 	contacts   *securecookie.SecureCookie
+
+	cluster   *ClusterConfig
+	transport ClusterTransport
+	directory SessionDirectory
+	stopCh    chan struct{}
+
+	backends *BackendManager
+	proxies  *proxy.Manager
+	logger   *zap.Logger
+
+	// turnRealms is keyed by BackendId first (the empty string holding the
+	// realms shared by every backend) and then by realm name, so that
+	// turning on realms for one backend cannot leak another backend's TURN
+	// secret to it.
+	turnRealms       map[string]map[string]*TurnRealmConfig
+	defaultTurnRealm map[string]string
+
+	limiter *RateLimiter
+
+	clusterRooms map[string]bool
 }
 
-func NewHub(config *Config, sessionSecret, encryptionSecret, turnSecret []byte, encoder OutgoingEncoder) Hub {
+func NewHub(config *Config, sessionSecret, encryptionSecret, turnSecret []byte, encoder OutgoingEncoder, cluster *ClusterConfig, backends *BackendManager, proxies *proxy.Manager, logger *zap.Logger, turnRealms []*TurnRealmConfig, rateLimit RateLimitConfig) Hub {
+
+	if logger == nil {
+		logger = zap.NewNop()
+	}
 
 	h := &hub{
-		OutgoingEncoder: encoder,
-		clients:         make(map[string]Client),
-		config:          config,
-		turnSecret:      turnSecret,
+		OutgoingEncoder:  encoder,
+		clients:          make(map[string]Client),
+		config:           config,
+		turnSecret:       turnSecret,
+		cluster:          cluster,
+		backends:         backends,
+		proxies:          proxies,
+		logger:           logger,
+		turnRealms:       make(map[string]map[string]*TurnRealmConfig),
+		defaultTurnRealm: make(map[string]string),
+		limiter:          NewRateLimiter(rateLimit),
+		clusterRooms:     make(map[string]bool),
+	}
+
+	for _, realm := range turnRealms {
+		perBackend, ok := h.turnRealms[realm.BackendId]
+		if !ok {
+			perBackend = make(map[string]*TurnRealmConfig)
+			h.turnRealms[realm.BackendId] = perBackend
+		}
+		perBackend[realm.Name] = realm
+		if h.defaultTurnRealm[realm.BackendId] == "" {
+			h.defaultTurnRealm[realm.BackendId] = realm.Name
+		}
 	}
 
 	h.contacts = securecookie.New(sessionSecret, encryptionSecret)
 	h.contacts.MaxAge(0) // Forever
 	h.contacts.HashFunc(sha256.New)
 	h.contacts.BlockFunc(aes.NewCipher)
+
+	if cluster != nil {
+		if err := h.joinCluster(cluster); err != nil {
+			h.logger.Error("Failed to join cluster", zap.String("node_id", cluster.NodeId), zap.Error(err))
+		}
+	}
+
 	return h
 
 }
 
+// joinCluster wires up the transport and session directory described by
+// cfg, subscribes to this node's own subject so remote nodes can forward
+// Unicast traffic to locally connected clients, and starts the heartbeat
+// that keeps the node entry in the directory alive.
+func (h *hub) joinCluster(cfg *ClusterConfig) error {
+	transport, err := NewClusterTransport(cfg)
+	if err != nil {
+		return err
+	}
+	directory, err := NewSessionDirectory(cfg)
+	if err != nil {
+		transport.Close()
+		return err
+	}
+
+	if err := transport.SubscribeNode(cfg.NodeId, h.onClusterMessage); err != nil {
+		transport.Close()
+		return err
+	}
+
+	h.transport = transport
+	h.directory = directory
+	h.stopCh = make(chan struct{})
+
+	interval := cfg.HeartbeatInterval
+	if interval == 0 {
+		interval = defaultHeartbeatInterval
+	}
+	ttl := cfg.NodeTTL
+	if ttl == 0 {
+		ttl = defaultNodeTTL
+	}
+	go runHeartbeat(directory, cfg.NodeId, interval, ttl, h.stopCh, h.logger)
+
+	return nil
+}
+
+// onClusterMessage is invoked when another node forwards an envelope meant
+// for a session owned by this node. The payload is re-encoded through the
+// regular OutgoingEncoder so that locally connected clients receive it
+// exactly as if it had been unicast in-process.
+func (h *hub) onClusterMessage(payload []byte) {
+	envelope := &clusterEnvelope{}
+	if err := json.Unmarshal(payload, envelope); err != nil {
+		h.logger.Error("Failed to decode cluster envelope", zap.Error(err))
+		return
+	}
+	client, ok := h.GetClient(envelope.To)
+	if !ok {
+		// The session has since moved on or disconnected, nothing to do.
+		return
+	}
+	if client.Session().Backend() != envelope.Backend {
+		h.logger.Warn("Refusing cross-backend cluster delivery",
+			zap.String("session_id", envelope.To),
+			zap.String("backend", envelope.Backend),
+		)
+		return
+	}
+	var data interface{}
+	if err := json.Unmarshal(envelope.Data, &data); err != nil {
+		h.logger.Error("Failed to decode cluster envelope data", zap.String("session_id", envelope.To), zap.Error(err))
+		return
+	}
+	outgoing := &DataOutgoing{
+		From: envelope.From,
+		To:   envelope.To,
+		Data: data,
+	}
+	if message, err := h.EncodeOutgoing(outgoing); err == nil {
+		client.Send(message)
+		message.Decref()
+	}
+}
+
+// EnsureClusterRoomSubscribed makes sure this node is subscribed to the
+// cluster subject of roomId (namespaced per backend so rooms of different
+// tenants never share a subject), so that broadcasts published by peer
+// nodes for that room reach this node's local members. It is a no-op when
+// clustering is not configured or the room is already subscribed. Callers
+// invoke this once a session has actually joined a room (RoomManager.JoinRoom),
+// not on connect, since a freshly connected session has no room yet.
+func (h *hub) EnsureClusterRoomSubscribed(roomId, backendId string) {
+	if h.transport == nil {
+		return
+	}
+	subject := h.clusterRoomSubject(roomId, backendId)
+
+	h.mutex.Lock()
+	if h.clusterRooms[subject] {
+		h.mutex.Unlock()
+		return
+	}
+	h.clusterRooms[subject] = true
+	h.mutex.Unlock()
+
+	if err := h.transport.SubscribeRoom(subject, func(payload []byte) {
+		h.onClusterRoomMessage(roomId, backendId, payload)
+	}); err != nil {
+		h.logger.Error("Failed to subscribe to cluster room", zap.String("room_id", roomId), zap.Error(err))
+	}
+}
+
+// clusterRoomSubject namespaces roomId by backend so that cluster-wide
+// room broadcasts respect the same tenant isolation as local ones.
+func (h *hub) clusterRoomSubject(roomId, backendId string) string {
+	return h.backends.RoomKey(backendId, roomId)
+}
+
+// onClusterRoomMessage is invoked when a peer node publishes a room
+// broadcast for a room this node is subscribed to. It delivers the
+// message to every locally connected client of backendId that is
+// currently in roomId.
+func (h *hub) onClusterRoomMessage(roomId, backendId string, payload []byte) {
+	envelope := &clusterEnvelope{}
+	if err := json.Unmarshal(payload, envelope); err != nil {
+		h.logger.Error("Failed to decode cluster room envelope", zap.String("room_id", roomId), zap.Error(err))
+		return
+	}
+	var data interface{}
+	if err := json.Unmarshal(envelope.Data, &data); err != nil {
+		h.logger.Error("Failed to decode cluster room envelope data", zap.String("room_id", roomId), zap.Error(err))
+		return
+	}
+	outgoing := &DataOutgoing{From: envelope.From, Data: data}
+	message, err := h.EncodeOutgoing(outgoing)
+	if err != nil {
+		return
+	}
+	defer message.Decref()
+
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	for id, client := range h.clients {
+		if id == envelope.From {
+			// Already delivered locally by the node that originated the
+			// broadcast, so skip it here to avoid a duplicate.
+			continue
+		}
+		peer := client.Session()
+		if peer.Roomid == roomId && peer.Backend() == backendId {
+			client.Send(message)
+		}
+	}
+}
+
+// BroadcastRoom delivers m to every locally connected client currently in
+// roomId and publishes it to the room's cluster subject so peer nodes
+// deliver it to their own members, implementing the cross-node half of
+// RoomManager.Broadcast. messageType is the wire type of m (e.g. "Chat",
+// "Status", "Bye" as used in DataIncoming.Type) and is what a single
+// abusive client flooding the room is throttled per, via the per-session
+// token-bucket limiter (Unicast, by contrast, is not rate limited).
+func (h *hub) BroadcastRoom(session *Session, roomId, messageType string, m interface{}) {
+	if !h.limiter.Allow(session.Id, messageType) {
+		if client, ok := h.GetClient(session.Id); ok {
+			client.Reply("Error", &DataError{Code: "rate_limited", Message: messageType})
+		}
+		h.logger.Warn("Rate limited room broadcast",
+			zap.String("session_id", session.Id),
+			zap.String("room_id", roomId),
+			zap.String("type", messageType),
+		)
+		return
+	}
+
+	outgoing := &DataOutgoing{From: session.Id, A: session.Attestation(), Data: m}
+	message, err := h.EncodeOutgoing(outgoing)
+	if err != nil {
+		return
+	}
+	defer message.Decref()
+
+	h.mutex.RLock()
+	for id, client := range h.clients {
+		if id == session.Id {
+			continue
+		}
+		peer := client.Session()
+		if peer.Roomid == roomId && peer.Backend() == session.Backend() {
+			client.Send(message)
+		}
+	}
+	h.mutex.RUnlock()
+
+	if h.transport == nil {
+		return
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		h.logger.Error("Failed to marshal room broadcast data", zap.String("room_id", roomId), zap.Error(err))
+		return
+	}
+	envelope := &clusterEnvelope{From: session.Id, Data: data}
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		h.logger.Error("Failed to marshal room broadcast envelope", zap.String("room_id", roomId), zap.Error(err))
+		return
+	}
+	subject := h.clusterRoomSubject(roomId, session.Backend())
+	if err := h.transport.PublishToRoom(subject, payload); err != nil {
+		h.logger.Error("Failed to publish room broadcast to cluster", zap.String("room_id", roomId), zap.Error(err))
+	}
+}
+
 func (h *hub) ClientInfo(details bool) (clientCount int, sessions map[string]*DataSession, connections map[string]string) {
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
@@ -118,26 +395,118 @@ func (h *hub) ClientInfo(details bool) (clientCount int, sessions map[string]*Da
 	return
 }
 
+// RateLimitStats reports the current token count and dropped message
+// count per message type for sessionId through the ClientStats interface.
+// ClientInfo does not include these figures.
+func (h *hub) RateLimitStats(sessionId string) map[string]*RateLimitStats {
+	return h.limiter.Stats(sessionId)
+}
+
+// Logger returns the structured logger the hub was built with, so other
+// components (e.g. the channelling API) can log with the same fields and
+// sampling configuration instead of each constructing its own.
+func (h *hub) Logger() *zap.Logger {
+	return h.logger
+}
+
 func (h *hub) CreateTurnData(session *Session) *DataTurn {
 
 	// Create turn data credentials for shared secret auth with TURN
 	// server. See http://tools.ietf.org/html/draft-uberti-behave-turn-rest-00
 	// and https://code.google.com/p/rfc5766-turn-server/ REST API auth
 	// and set shared secret in TURN server with static-auth-secret.
-	if len(h.turnSecret) == 0 {
+	if realm, ok := h.turnRealm(session); ok {
+		user, password := createTurnCredentials(realm, session.Id)
+		return &DataTurn{user, password, realm.ttlOrDefault(), realm.URIs}
+	}
+
+	turnSecret := h.turnSecret
+	turnURIs := h.config.TurnURIs
+	if config, ok := h.backends.Get(session.Backend()); ok {
+		turnSecret = config.Secret
+		turnURIs = config.TurnURIs
+	}
+	if len(turnSecret) == 0 {
 		return &DataTurn{}
 	}
 	id := session.Id
 	bar := sha256.New()
 	bar.Write([]byte(id))
 	id = base64.StdEncoding.EncodeToString(bar.Sum(nil))
-	foo := hmac.New(sha1.New, h.turnSecret)
+	foo := hmac.New(sha1.New, turnSecret)
 	expiration := int32(time.Now().Unix()) + turnTTL
 	user := fmt.Sprintf("%d:%s", expiration, id)
 	foo.Write([]byte(user))
 	password := base64.StdEncoding.EncodeToString(foo.Sum(nil))
-	return &DataTurn{user, password, turnTTL, h.config.TurnURIs}
+	return &DataTurn{user, password, turnTTL, turnURIs}
+
+}
 
+// CreateTurnRealms returns TURN credentials for every realm configured for
+// session's backend (plus every realm shared across all backends) so the
+// client can race ICE gathering across all of them, preferring the realm
+// requested by session if any.
+func (h *hub) CreateTurnRealms(session *Session) []*DataTurnRealm {
+	realmsByName := h.realmsForBackend(session.Backend())
+	realms := make([]*DataTurnRealm, 0, len(realmsByName))
+	requested := session.Realm()
+	for _, realm := range realmsByName {
+		user, password := createTurnCredentials(realm, session.Id)
+		entry := &DataTurnRealm{
+			Realm:    realm.Name,
+			Username: user,
+			Password: password,
+			TTL:      realm.ttlOrDefault(),
+			URIs:     realm.URIs,
+			Quota:    realm.Quota,
+		}
+		if requested != "" && realm.Name == requested {
+			// The requested realm goes first.
+			realms = append([]*DataTurnRealm{entry}, realms...)
+		} else {
+			realms = append(realms, entry)
+		}
+	}
+	return realms
+}
+
+// realmsForBackend returns every realm usable by backendId: the realms
+// configured specifically for it plus the realms shared across all
+// backends (registered with an empty BackendId), without ever returning a
+// realm scoped to a different backend.
+func (h *hub) realmsForBackend(backendId string) map[string]*TurnRealmConfig {
+	realms := make(map[string]*TurnRealmConfig)
+	for name, realm := range h.turnRealms[""] {
+		realms[name] = realm
+	}
+	if backendId != "" {
+		for name, realm := range h.turnRealms[backendId] {
+			realms[name] = realm
+		}
+	}
+	return realms
+}
+
+// turnRealm resolves the realm requested by session (e.g. the
+// geographically nearest one), falling back to the default realm. It
+// returns false when no realms are configured at all, in which case the
+// caller should fall back to the legacy single-secret behavior.
+func (h *hub) turnRealm(session *Session) (*TurnRealmConfig, bool) {
+	realms := h.realmsForBackend(session.Backend())
+	if len(realms) == 0 {
+		return nil, false
+	}
+	if realm, ok := realms[session.Realm()]; ok {
+		return realm, true
+	}
+	defaultName := h.defaultTurnRealm[session.Backend()]
+	if defaultName == "" {
+		defaultName = h.defaultTurnRealm[""]
+	}
+	if realm, ok := realms[defaultName]; ok {
+		return realm, true
+	}
+	return nil, false
 }
 
 func (h *hub) GetSession(id string) (session *Session, ok bool) {
@@ -154,23 +523,55 @@ func (h *hub) OnConnect(client Client, session *Session) {
 
 	h.mutex.Lock()
 
-	log.Printf("Created client with id %s", session.Id)
+	h.logger.Info("Created client", zap.String("session_id", session.Id))
 
 	// Register connection or replace existing one.
 	if ec, ok := h.clients[session.Id]; ok {
 		ec.Close(false)
-		//log.Printf("Register (%d) from %s: %s (existing)\n", c.Idx, c.Id)
 	}
 	h.clients[session.Id] = client
-	//fmt.Println("registered", c.Id)
 	h.mutex.Unlock()
-	//log.Printf("Register (%d) from %s: %s\n", c.Idx, c.Id)
+
+	if h.directory != nil {
+		ttl := h.cluster.NodeTTL
+		if ttl == 0 {
+			ttl = defaultNodeTTL
+		}
+		if err := h.directory.Register(session.Id, h.cluster.NodeId, session.Backend(), ttl); err != nil {
+			h.logger.Error("Failed to register session with cluster directory", zap.String("session_id", session.Id), zap.Error(err))
+		}
+	}
+
+	// Placing the session on a media proxy here, the mirror of Release in
+	// OnDisconnect, is what makes Unicast's IsManaged fast path and
+	// sendToProxy ever actually fire; ErrNoProxyAvailable just means this
+	// session is handled in-process like before proxies existed.
+	if h.proxies != nil {
+		if _, err := h.proxies.Place(session.Id, session.Backend()); err != nil {
+			h.logger.Warn("Failed to place session on a media proxy, handling it in-process",
+				zap.String("session_id", session.Id),
+				zap.Error(err),
+			)
+		}
+	}
 }
 
 func (h *hub) OnDisconnect(session *Session) {
 	h.mutex.Lock()
 	delete(h.clients, session.Id)
 	h.mutex.Unlock()
+
+	if h.directory != nil {
+		if err := h.directory.Unregister(session.Id); err != nil {
+			h.logger.Error("Failed to unregister session from cluster directory", zap.String("session_id", session.Id), zap.Error(err))
+		}
+	}
+
+	if h.proxies != nil {
+		h.proxies.Release(session.Id)
+	}
+
+	h.limiter.Release(session.Id)
 }
 
 func (h *hub) GetClient(id string) (client Client, ok bool) {
@@ -180,6 +581,10 @@ func (h *hub) GetClient(id string) (client Client, ok bool) {
 	return
 }
 
+// Unicast delivers point-to-point signaling (offers, answers, candidates)
+// to a single peer session. It is not rate limited: the flood vector this
+// backlog's rate limiting addresses is a single client spamming a whole
+// room via BroadcastRoom, not one-to-one signaling.
 func (h *hub) Unicast(session *Session, to string, m interface{}) {
 	outgoing := &DataOutgoing{
 		From: session.Id,
@@ -187,10 +592,36 @@ func (h *hub) Unicast(session *Session, to string, m interface{}) {
 		A:    session.Attestation(),
 		Data: m,
 	}
+	if h.proxies != nil {
+		if address, backendId, ok := h.proxies.IsManaged(to); ok {
+			if backendId != session.Backend() {
+				h.logger.Warn("Refusing cross-backend proxy unicast",
+					zap.String("session_id", session.Id),
+					zap.String("peer_id", to),
+					zap.String("backend", session.Backend()),
+				)
+				return
+			}
+			h.sendToProxy(address, outgoing)
+			return
+		}
+	}
+
 	if message, err := h.EncodeOutgoing(outgoing); err == nil {
 		client, ok := h.GetClient(to)
 		if !ok {
-			log.Println("Unicast To not found", to)
+			if h.forwardToCluster(session, to, m) {
+				return
+			}
+			h.logger.Warn("Unicast to not found", zap.String("session_id", session.Id), zap.String("peer_id", to))
+			return
+		}
+		if session.Backend() != client.Session().Backend() {
+			h.logger.Warn("Refusing cross-backend unicast",
+				zap.String("session_id", session.Id),
+				zap.String("peer_id", to),
+				zap.String("backend", session.Backend()),
+			)
 			return
 		}
 		client.Send(message)
@@ -198,6 +629,88 @@ func (h *hub) Unicast(session *Session, to string, m interface{}) {
 	}
 }
 
+// sendToProxy forwards a unicast destined for a proxy-managed publisher
+// over the gRPC signaling stream instead of delivering it to a local
+// Client. Only SDP offer/answer and ICE candidate payloads are relayed;
+// anything else is logged and dropped since a media proxy only speaks the
+// signaling subset of the protocol.
+func (h *hub) sendToProxy(address string, outgoing *DataOutgoing) {
+	client, ok := h.proxies.ClientFor(address)
+	if !ok {
+		h.logger.Error("Unicast to unknown proxy address", zap.String("peer_id", outgoing.To), zap.String("proxy_address", address))
+		return
+	}
+
+	msg := &proxy.SignalMessage{SessionId: outgoing.To}
+	switch data := outgoing.Data.(type) {
+	case *DataOffer:
+		msg.Payload = &proxy.SignalMessage_OfferSdp{OfferSdp: data.Sdp}
+	case *DataAnswer:
+		msg.Payload = &proxy.SignalMessage_AnswerSdp{AnswerSdp: data.Sdp}
+	case *DataCandidate:
+		msg.Payload = &proxy.SignalMessage_Candidate{Candidate: &proxy.IceCandidate{
+			Candidate:     data.Candidate,
+			SdpMid:        data.SdpMid,
+			SdpMLineIndex: int32(data.SdpMLineIndex),
+		}}
+	default:
+		h.logger.Error("Cannot relay message to proxy",
+			zap.String("proxy_address", address),
+			zap.String("type", fmt.Sprintf("%T", outgoing.Data)),
+		)
+		return
+	}
+
+	stream, err := client.Signal(context.Background())
+	if err != nil {
+		h.logger.Error("Failed to open signal stream to proxy", zap.String("proxy_address", address), zap.Error(err))
+		return
+	}
+	defer stream.CloseSend()
+	if err := stream.Send(msg); err != nil {
+		h.logger.Error("Failed to relay message to proxy", zap.String("proxy_address", address), zap.Error(err))
+	}
+}
+
+// forwardToCluster looks up the node that owns the "to" session in the
+// shared session directory and, if found on another node, publishes the
+// envelope to that node's subject. It returns false when clustering is not
+// configured or the session is unknown, so the caller can fall back to its
+// normal "not found" handling.
+func (h *hub) forwardToCluster(session *Session, to string, m interface{}) bool {
+	if h.directory == nil || h.transport == nil {
+		return false
+	}
+	nodeId, backendId, ok := h.directory.Lookup(to)
+	if !ok || nodeId == h.cluster.NodeId {
+		return false
+	}
+	if backendId != session.Backend() {
+		h.logger.Warn("Refusing cross-backend cluster forward",
+			zap.String("session_id", session.Id),
+			zap.String("peer_id", to),
+			zap.String("backend", session.Backend()),
+		)
+		return false
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		h.logger.Error("Failed to marshal cluster envelope data", zap.Error(err))
+		return false
+	}
+	envelope := &clusterEnvelope{From: session.Id, To: to, Backend: session.Backend(), Data: data}
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		h.logger.Error("Failed to marshal cluster envelope", zap.Error(err))
+		return false
+	}
+	if err := h.transport.PublishToNode(nodeId, payload); err != nil {
+		h.logger.Error("Failed to forward unicast to node", zap.String("node_id", nodeId), zap.Error(err))
+		return false
+	}
+	return true
+}
+
 func (h *hub) getContactID(session *Session, token string) (userid string, err error) {
 	contact := &Contact{}
 	err = h.contacts.Decode("contact", token, contact)
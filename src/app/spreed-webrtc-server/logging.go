@@ -0,0 +1,64 @@
+/*
+ * Spreed WebRTC.
+ * Copyright (C) 2013-2014 struktur AG
+ *
+ * This file is part of Spreed WebRTC.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// LogConfig holds the settings for the [log] config section used to build
+// the structured logger shared by the hub and the channelling API.
+type LogConfig struct {
+	Level              string // "debug", "info", "warn" or "error"
+	Encoding           string // "console" or "json"
+	SamplingInitial    int
+	SamplingThereafter int
+}
+
+// NewLogger builds a *zap.Logger from cfg. A nil cfg or empty fields fall
+// back to a sane production default (info level, JSON encoding) so callers
+// can pass the parsed config section as-is.
+func NewLogger(cfg *LogConfig) (*zap.Logger, error) {
+	zcfg := zap.NewProductionConfig()
+
+	if cfg != nil {
+		if cfg.Encoding != "" {
+			zcfg.Encoding = cfg.Encoding
+		}
+		if cfg.Level != "" {
+			level, err := zapcore.ParseLevel(cfg.Level)
+			if err != nil {
+				return nil, err
+			}
+			zcfg.Level = zap.NewAtomicLevelAt(level)
+		}
+		if cfg.SamplingInitial > 0 || cfg.SamplingThereafter > 0 {
+			zcfg.Sampling = &zap.SamplingConfig{
+				Initial:    cfg.SamplingInitial,
+				Thereafter: cfg.SamplingThereafter,
+			}
+		}
+	}
+
+	return zcfg.Build()
+}
@@ -0,0 +1,37 @@
+/*
+ * Spreed WebRTC.
+ * Copyright (C) 2013-2014 struktur AG
+ *
+ * This file is part of Spreed WebRTC.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package proxy
+
+import "encoding/json"
+
+// proxyCodec lets MediaProxyClient speak plain JSON instead of protobuf,
+// since the types in proxy.pb.go have no generated proto.Message
+// implementation for grpc-go's default codec to use. Every Dial in this
+// package must pass grpc.WithDefaultCallOptions(grpc.ForceCodec(proxyCodec{}))
+// or calls will fail at the default codec's proto.Message type assertion.
+type proxyCodec struct{}
+
+func (proxyCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+func (proxyCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+func (proxyCodec) Name() string { return "spreed-proxy-json" }
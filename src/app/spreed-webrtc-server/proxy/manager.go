@@ -0,0 +1,330 @@
+/*
+ * Spreed WebRTC.
+ * Copyright (C) 2013-2014 struktur AG
+ *
+ * This file is part of Spreed WebRTC.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package proxy offloads SDP and ICE candidate relaying for a publisher to
+// a remote media proxy (e.g. Janus) instead of handling it in the hub
+// process, so media handling can scale across multiple proxy instances.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"google.golang.org/grpc"
+)
+
+var ErrNoProxyAvailable = errors.New("proxy: no healthy proxy available")
+
+// Config describes how publishers should be placed onto remote media
+// proxies.
+type Config struct {
+	// Static is the list of statically configured proxy addresses.
+	Static []string
+	// EtcdEndpoints, when set, is watched for proxy addresses registered
+	// under the etcdProxyPrefix ("spreed/proxies/") prefix in addition to
+	// Static, so proxies can register/unregister themselves at runtime.
+	EtcdEndpoints []string
+	// HealthCheckInterval is how often Health is polled on every proxy.
+	HealthCheckInterval time.Duration
+	// Policy selects how a publisher is placed onto a proxy.
+	Policy PlacementPolicy
+}
+
+// PlacementPolicy decides which proxy a new publisher should be placed on.
+type PlacementPolicy int
+
+const (
+	RoundRobin PlacementPolicy = iota
+	LeastLoaded
+)
+
+// assignment remembers which proxy a publisher session was placed on
+// together with the backend it belongs to, so callers can refuse to relay
+// a message to a publisher placed by a different tenant.
+type assignment struct {
+	address   string
+	backendId string
+}
+
+type proxyNode struct {
+	address string
+	conn    *grpc.ClientConn
+	client  MediaProxyClient
+	mutex   sync.Mutex
+	healthy bool
+	load    int32
+}
+
+// etcdProxyPrefix is where proxies registered themselves under in etcd,
+// each key holding the proxy's dial address as its value.
+const etcdProxyPrefix = "spreed/proxies/"
+
+// Manager discovers media proxies, health-checks them and decides which
+// proxy a new publisher session is placed on.
+type Manager struct {
+	config Config
+
+	etcdClient *clientv3.Client
+
+	mutex  sync.RWMutex
+	nodes  []*proxyNode
+	next   int
+	stopCh chan struct{}
+
+	// publishers maps a session id to the proxy address currently handling
+	// it, so the hub can route subsequent messages for that session.
+	publishers sync.Map
+}
+
+func NewManager(config Config) (*Manager, error) {
+	m := &Manager{
+		config: config,
+		stopCh: make(chan struct{}),
+	}
+	for _, address := range config.Static {
+		if err := m.addNode(address); err != nil {
+			return nil, err
+		}
+	}
+	if len(config.EtcdEndpoints) > 0 {
+		client, err := clientv3.New(clientv3.Config{Endpoints: config.EtcdEndpoints})
+		if err != nil {
+			return nil, err
+		}
+		m.etcdClient = client
+		if err := m.loadEtcdProxies(); err != nil {
+			return nil, err
+		}
+		go m.watchEtcdProxies()
+	}
+	interval := config.HealthCheckInterval
+	if interval == 0 {
+		interval = 10 * time.Second
+	}
+	go m.runHealthChecks(interval)
+	return m, nil
+}
+
+// loadEtcdProxies populates the initial set of proxies already registered
+// under etcdProxyPrefix, in addition to config.Static.
+func (m *Manager) loadEtcdProxies() error {
+	resp, err := m.etcdClient.Get(context.Background(), etcdProxyPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	for _, kv := range resp.Kvs {
+		if err := m.addNode(string(kv.Value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watchEtcdProxies keeps m.nodes in sync with proxies registering and
+// unregistering under etcdProxyPrefix until m.stopCh is closed.
+func (m *Manager) watchEtcdProxies() {
+	watch := m.etcdClient.Watch(context.Background(), etcdProxyPrefix, clientv3.WithPrefix(), clientv3.WithPrevKV())
+	for {
+		select {
+		case resp, ok := <-watch:
+			if !ok {
+				return
+			}
+			for _, event := range resp.Events {
+				switch event.Type {
+				case clientv3.EventTypePut:
+					m.addNode(string(event.Kv.Value))
+				case clientv3.EventTypeDelete:
+					if event.PrevKv != nil {
+						m.removeNode(string(event.PrevKv.Value))
+					}
+				}
+			}
+		case <-m.stopCh:
+			return
+		}
+	}
+}
+
+// removeNode closes and drops the proxy at address, called when etcd
+// reports it has unregistered.
+func (m *Manager) removeNode(address string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for i, node := range m.nodes {
+		if node.address == address {
+			node.conn.Close()
+			m.nodes = append(m.nodes[:i], m.nodes[i+1:]...)
+			return
+		}
+	}
+}
+
+func (m *Manager) addNode(address string) error {
+	conn, err := grpc.Dial(address, grpc.WithInsecure(), grpc.WithDefaultCallOptions(grpc.ForceCodec(proxyCodec{})))
+	if err != nil {
+		return err
+	}
+	node := &proxyNode{
+		address: address,
+		conn:    conn,
+		client:  NewMediaProxyClient(conn),
+		healthy: true,
+	}
+	m.mutex.Lock()
+	m.nodes = append(m.nodes, node)
+	m.mutex.Unlock()
+	return nil
+}
+
+func (m *Manager) runHealthChecks(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.checkHealth()
+		case <-m.stopCh:
+			return
+		}
+	}
+}
+
+func (m *Manager) checkHealth() {
+	m.mutex.RLock()
+	nodes := make([]*proxyNode, len(m.nodes))
+	copy(nodes, m.nodes)
+	m.mutex.RUnlock()
+
+	for _, node := range nodes {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		resp, err := node.client.Health(ctx, &HealthRequest{})
+		cancel()
+
+		node.mutex.Lock()
+		if err != nil {
+			node.healthy = false
+		} else {
+			node.healthy = resp.Healthy
+			node.load = resp.PublisherCount
+		}
+		node.mutex.Unlock()
+	}
+}
+
+// Place picks a healthy proxy for a new publisher session according to the
+// configured PlacementPolicy and remembers the assignment, together with
+// backendId, so IsManaged can be used for subsequent messages of the same
+// session without crossing a tenant boundary.
+func (m *Manager) Place(sessionId, backendId string) (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var chosen *proxyNode
+	switch m.config.Policy {
+	case LeastLoaded:
+		var lowest int32 = -1
+		for _, node := range m.nodes {
+			node.mutex.Lock()
+			healthy, load := node.healthy, node.load
+			node.mutex.Unlock()
+			if !healthy {
+				continue
+			}
+			if lowest == -1 || load < lowest {
+				lowest = load
+				chosen = node
+			}
+		}
+	default: // RoundRobin
+		for i := 0; i < len(m.nodes); i++ {
+			idx := (m.next + i) % len(m.nodes)
+			node := m.nodes[idx]
+			node.mutex.Lock()
+			healthy := node.healthy
+			node.mutex.Unlock()
+			if healthy {
+				chosen = node
+				m.next = idx + 1
+				break
+			}
+		}
+	}
+
+	if chosen == nil {
+		return "", ErrNoProxyAvailable
+	}
+	m.publishers.Store(sessionId, &assignment{address: chosen.address, backendId: backendId})
+	return chosen.address, nil
+}
+
+// Release forgets the proxy assignment for sessionId, called when the
+// publisher disconnects.
+func (m *Manager) Release(sessionId string) {
+	m.publishers.Delete(sessionId)
+}
+
+// IsManaged reports whether sessionId is currently handled by a media
+// proxy rather than in-process, and which backend placed it there.
+func (m *Manager) IsManaged(sessionId string) (address, backendId string, ok bool) {
+	value, found := m.publishers.Load(sessionId)
+	if !found {
+		return "", "", false
+	}
+	a := value.(*assignment)
+	return a.address, a.backendId, true
+}
+
+// ClientFor returns the MediaProxyClient for address, or false if address
+// is not a known proxy.
+func (m *Manager) ClientFor(address string) (MediaProxyClient, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	for _, node := range m.nodes {
+		if node.address == address {
+			return node.client, true
+		}
+	}
+	return nil, false
+}
+
+// Close stops health checking and etcd watching and closes every proxy
+// connection.
+func (m *Manager) Close() error {
+	close(m.stopCh)
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var err error
+	for _, node := range m.nodes {
+		if cerr := node.conn.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	if m.etcdClient != nil {
+		if cerr := m.etcdClient.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
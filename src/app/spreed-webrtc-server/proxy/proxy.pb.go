@@ -0,0 +1,128 @@
+// Hand-written counterpart of proxy.proto.
+//
+// This is NOT the output of protoc-gen-go: the messages below are wire
+// types for proxyCodec (see codec.go), a plain JSON grpc.Codec, not real
+// protobuf-generated structs (no proto.Message/Reset/ProtoReflect, no wire
+// marshaling). A real media proxy speaking the checked-in .proto over
+// protobuf will not interoperate with this; if protobuf wire compatibility
+// is ever required, run protoc/protoc-gen-go and replace this file with
+// its output.
+
+package proxy
+
+import "encoding/json"
+
+// SignalMessage mirrors the protobuf message of the same name. Payload
+// models the "payload" oneof from proxy.proto: exactly one of OfferSdp,
+// AnswerSdp or Candidate is set, carried through isSignalPayload so callers
+// can switch on the concrete type the way generated oneof wrappers do.
+type SignalMessage struct {
+	SessionId string
+	Payload   isSignalPayload
+}
+
+type isSignalPayload interface {
+	isSignalPayload()
+}
+
+type SignalMessage_OfferSdp struct {
+	OfferSdp string
+}
+
+type SignalMessage_AnswerSdp struct {
+	AnswerSdp string
+}
+
+type SignalMessage_Candidate struct {
+	Candidate *IceCandidate
+}
+
+func (*SignalMessage_OfferSdp) isSignalPayload()  {}
+func (*SignalMessage_AnswerSdp) isSignalPayload() {}
+func (*SignalMessage_Candidate) isSignalPayload() {}
+
+// signalMessageWire is the flattened representation of SignalMessage that
+// actually travels over proxyCodec, since encoding/json cannot unmarshal
+// into an interface-typed oneof field without somewhere to learn the
+// concrete type from.
+type signalMessageWire struct {
+	SessionId string        `json:"session_id"`
+	OfferSdp  string        `json:"offer_sdp,omitempty"`
+	AnswerSdp string        `json:"answer_sdp,omitempty"`
+	Candidate *IceCandidate `json:"candidate,omitempty"`
+}
+
+func (m *SignalMessage) MarshalJSON() ([]byte, error) {
+	wire := signalMessageWire{SessionId: m.SessionId}
+	switch p := m.Payload.(type) {
+	case *SignalMessage_OfferSdp:
+		wire.OfferSdp = p.OfferSdp
+	case *SignalMessage_AnswerSdp:
+		wire.AnswerSdp = p.AnswerSdp
+	case *SignalMessage_Candidate:
+		wire.Candidate = p.Candidate
+	}
+	return json.Marshal(wire)
+}
+
+func (m *SignalMessage) UnmarshalJSON(data []byte) error {
+	wire := signalMessageWire{}
+	if err := json.Unmarshal(data, &wire); err != nil {
+		return err
+	}
+	m.SessionId = wire.SessionId
+	switch {
+	case wire.Candidate != nil:
+		m.Payload = &SignalMessage_Candidate{Candidate: wire.Candidate}
+	case wire.AnswerSdp != "":
+		m.Payload = &SignalMessage_AnswerSdp{AnswerSdp: wire.AnswerSdp}
+	case wire.OfferSdp != "":
+		m.Payload = &SignalMessage_OfferSdp{OfferSdp: wire.OfferSdp}
+	}
+	return nil
+}
+
+// GetOfferSdp returns the offer SDP carried by m, or "" if Payload holds
+// something else, mirroring a generated oneof getter.
+func (m *SignalMessage) GetOfferSdp() string {
+	if p, ok := m.Payload.(*SignalMessage_OfferSdp); ok {
+		return p.OfferSdp
+	}
+	return ""
+}
+
+// GetAnswerSdp returns the answer SDP carried by m, or "" if Payload holds
+// something else.
+func (m *SignalMessage) GetAnswerSdp() string {
+	if p, ok := m.Payload.(*SignalMessage_AnswerSdp); ok {
+		return p.AnswerSdp
+	}
+	return ""
+}
+
+// GetCandidate returns the ICE candidate carried by m, or nil if Payload
+// holds something else.
+func (m *SignalMessage) GetCandidate() *IceCandidate {
+	if p, ok := m.Payload.(*SignalMessage_Candidate); ok {
+		return p.Candidate
+	}
+	return nil
+}
+
+// IceCandidate mirrors the protobuf message of the same name.
+type IceCandidate struct {
+	Candidate     string
+	SdpMid        string
+	SdpMLineIndex int32
+}
+
+// HealthRequest mirrors the protobuf message of the same name.
+type HealthRequest struct {
+}
+
+// HealthResponse mirrors the protobuf message of the same name.
+type HealthResponse struct {
+	Healthy        bool
+	PublisherCount int32
+	Capacity       int32
+}
@@ -0,0 +1,71 @@
+// Hand-written counterpart of proxy.proto.
+//
+// This is NOT the output of protoc-gen-go-grpc. MediaProxyClient is a
+// minimal client stub wired to proxyCodec (see codec.go) rather than the
+// real generated gRPC machinery; see the note atop proxy.pb.go for why.
+
+package proxy
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+)
+
+// MediaProxyClient is the client API for the MediaProxy service.
+type MediaProxyClient interface {
+	Signal(ctx context.Context, opts ...grpc.CallOption) (MediaProxy_SignalClient, error)
+	Health(ctx context.Context, in *HealthRequest, opts ...grpc.CallOption) (*HealthResponse, error)
+}
+
+// MediaProxy_SignalClient is the bidirectional stream returned by Signal.
+type MediaProxy_SignalClient interface {
+	Send(*SignalMessage) error
+	Recv() (*SignalMessage, error)
+	CloseSend() error
+}
+
+type mediaProxyClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewMediaProxyClient(cc *grpc.ClientConn) MediaProxyClient {
+	return &mediaProxyClient{cc: cc}
+}
+
+func (c *mediaProxyClient) Signal(ctx context.Context, opts ...grpc.CallOption) (MediaProxy_SignalClient, error) {
+	stream, err := c.cc.NewStream(ctx, &grpc.StreamDesc{
+		StreamName:    "Signal",
+		ServerStreams: true,
+		ClientStreams: true,
+	}, "/proxy.MediaProxy/Signal", opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &mediaProxySignalClient{stream}, nil
+}
+
+type mediaProxySignalClient struct {
+	grpc.ClientStream
+}
+
+func (c *mediaProxySignalClient) Send(m *SignalMessage) error {
+	return c.ClientStream.SendMsg(m)
+}
+
+func (c *mediaProxySignalClient) Recv() (*SignalMessage, error) {
+	m := new(SignalMessage)
+	if err := c.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *mediaProxyClient) Health(ctx context.Context, in *HealthRequest, opts ...grpc.CallOption) (*HealthResponse, error) {
+	out := new(HealthResponse)
+	err := c.cc.Invoke(ctx, "/proxy.MediaProxy/Health", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,109 @@
+/*
+ * Spreed WebRTC.
+ * Copyright (C) 2013-2014 struktur AG
+ *
+ * This file is part of Spreed WebRTC.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package proxy
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSignalMessageJSONRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  *SignalMessage
+	}{
+		{"offer", &SignalMessage{SessionId: "s1", Payload: &SignalMessage_OfferSdp{OfferSdp: "v=0..."}}},
+		{"answer", &SignalMessage{SessionId: "s1", Payload: &SignalMessage_AnswerSdp{AnswerSdp: "v=0..."}}},
+		{"candidate", &SignalMessage{SessionId: "s1", Payload: &SignalMessage_Candidate{Candidate: &IceCandidate{Candidate: "candidate:1", SdpMid: "0", SdpMLineIndex: 1}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(tt.msg)
+			if err != nil {
+				t.Fatalf("Marshal failed: %s", err)
+			}
+			got := &SignalMessage{}
+			if err := json.Unmarshal(data, got); err != nil {
+				t.Fatalf("Unmarshal failed: %s", err)
+			}
+			if got.SessionId != tt.msg.SessionId {
+				t.Errorf("SessionId = %q, want %q", got.SessionId, tt.msg.SessionId)
+			}
+			switch want := tt.msg.Payload.(type) {
+			case *SignalMessage_OfferSdp:
+				if got.GetOfferSdp() != want.OfferSdp {
+					t.Errorf("GetOfferSdp() = %q, want %q", got.GetOfferSdp(), want.OfferSdp)
+				}
+			case *SignalMessage_AnswerSdp:
+				if got.GetAnswerSdp() != want.AnswerSdp {
+					t.Errorf("GetAnswerSdp() = %q, want %q", got.GetAnswerSdp(), want.AnswerSdp)
+				}
+			case *SignalMessage_Candidate:
+				if got.GetCandidate() == nil || got.GetCandidate().Candidate != want.Candidate.Candidate {
+					t.Errorf("GetCandidate() = %+v, want %+v", got.GetCandidate(), want.Candidate)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyCodecRoundTrip(t *testing.T) {
+	codec := proxyCodec{}
+	in := &SignalMessage{SessionId: "s1", Payload: &SignalMessage_OfferSdp{OfferSdp: "v=0..."}}
+
+	data, err := codec.Marshal(in)
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+	out := &SignalMessage{}
+	if err := codec.Unmarshal(data, out); err != nil {
+		t.Fatalf("Unmarshal failed: %s", err)
+	}
+	if out.GetOfferSdp() != "v=0..." {
+		t.Errorf("GetOfferSdp() = %q, want %q", out.GetOfferSdp(), "v=0...")
+	}
+}
+
+func TestManagerPlaceTracksBackend(t *testing.T) {
+	m := &Manager{nodes: []*proxyNode{{address: "proxy-1", healthy: true}}}
+
+	address, err := m.Place("session-1", "tenant-a")
+	if err != nil {
+		t.Fatalf("Place failed: %s", err)
+	}
+	if address != "proxy-1" {
+		t.Errorf("Place address = %q, want %q", address, "proxy-1")
+	}
+
+	gotAddress, gotBackend, ok := m.IsManaged("session-1")
+	if !ok {
+		t.Fatalf("IsManaged reported not found right after Place")
+	}
+	if gotAddress != "proxy-1" || gotBackend != "tenant-a" {
+		t.Errorf("IsManaged = (%q, %q), want (%q, %q)", gotAddress, gotBackend, "proxy-1", "tenant-a")
+	}
+
+	m.Release("session-1")
+	if _, _, ok := m.IsManaged("session-1"); ok {
+		t.Errorf("IsManaged still reports found after Release")
+	}
+}
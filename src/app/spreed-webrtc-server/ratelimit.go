@@ -0,0 +1,179 @@
+/*
+ * Spreed WebRTC.
+ * Copyright (C) 2013-2014 struktur AG
+ *
+ * This file is part of Spreed WebRTC.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DataError is sent back to a client via Client.Reply when a request is
+// rejected, such as when it is throttled by the rate limiter.
+type DataError struct {
+	Code    string `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// RateLimitConfig configures the per-session token-bucket rate limiter.
+// PerMessageType overrides GlobalPerSecond for individual message types
+// (e.g. "Chat", "Status", "Bye"); a message type not listed there uses
+// GlobalPerSecond.
+type RateLimitConfig struct {
+	GlobalPerSecond float64
+	PerMessageType  map[string]float64
+}
+
+// tokenBucket is a simple token-bucket limiter refilled at a constant rate
+// up to capacity, consumed one token per allowed message.
+type tokenBucket struct {
+	mutex    sync.Mutex
+	tokens   float64
+	capacity float64
+	perSec   float64
+	last     time.Time
+}
+
+func newTokenBucket(perSec float64) *tokenBucket {
+	return &tokenBucket{
+		tokens:   perSec,
+		capacity: perSec,
+		perSec:   perSec,
+		last:     time.Now(),
+	}
+}
+
+func (b *tokenBucket) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+
+	b.tokens += elapsed * b.perSec
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *tokenBucket) current() float64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.tokens
+}
+
+// RateLimitStats is the per session/message-type snapshot reported through
+// ClientStats so operators can see how close a client is to being
+// throttled.
+type RateLimitStats struct {
+	Tokens  float64
+	Dropped int64
+}
+
+// RateLimiter enforces a per-session, per-message-type token bucket so a
+// single abusive client cannot flood a room with Status/Chat/Bye messages.
+type RateLimiter struct {
+	config  RateLimitConfig
+	mutex   sync.Mutex
+	buckets map[string]map[string]*tokenBucket
+	dropped map[string]map[string]*int64
+}
+
+func NewRateLimiter(config RateLimitConfig) *RateLimiter {
+	if config.GlobalPerSecond <= 0 {
+		config.GlobalPerSecond = maxBroadcastPerSecond
+	}
+	return &RateLimiter{
+		config:  config,
+		buckets: make(map[string]map[string]*tokenBucket),
+		dropped: make(map[string]map[string]*int64),
+	}
+}
+
+func (l *RateLimiter) rateFor(messageType string) float64 {
+	if rate, ok := l.config.PerMessageType[messageType]; ok {
+		return rate
+	}
+	return l.config.GlobalPerSecond
+}
+
+// Allow reports whether sessionId may send another message of messageType
+// right now, consuming a token if so. Every dropped message is counted so
+// it shows up in Stats.
+func (l *RateLimiter) Allow(sessionId, messageType string) bool {
+	l.mutex.Lock()
+	perType, ok := l.buckets[sessionId]
+	if !ok {
+		perType = make(map[string]*tokenBucket)
+		l.buckets[sessionId] = perType
+		l.dropped[sessionId] = make(map[string]*int64)
+	}
+	bucket, ok := perType[messageType]
+	if !ok {
+		bucket = newTokenBucket(l.rateFor(messageType))
+		perType[messageType] = bucket
+		var zero int64
+		l.dropped[sessionId][messageType] = &zero
+	}
+	dropped := l.dropped[sessionId][messageType]
+	l.mutex.Unlock()
+
+	if bucket.allow() {
+		return true
+	}
+	atomic.AddInt64(dropped, 1)
+	return false
+}
+
+// Release forgets every bucket associated with sessionId, called when the
+// session disconnects.
+func (l *RateLimiter) Release(sessionId string) {
+	l.mutex.Lock()
+	delete(l.buckets, sessionId)
+	delete(l.dropped, sessionId)
+	l.mutex.Unlock()
+}
+
+// Stats returns a snapshot of the current token count and dropped message
+// count for every message type sessionId has sent so far.
+func (l *RateLimiter) Stats(sessionId string) map[string]*RateLimitStats {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	perType := l.buckets[sessionId]
+	perTypeDropped := l.dropped[sessionId]
+	stats := make(map[string]*RateLimitStats, len(perType))
+	for messageType, bucket := range perType {
+		stats[messageType] = &RateLimitStats{
+			Tokens:  bucket.current(),
+			Dropped: atomic.LoadInt64(perTypeDropped[messageType]),
+		}
+	}
+	return stats
+}
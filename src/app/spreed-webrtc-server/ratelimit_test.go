@@ -0,0 +1,78 @@
+/*
+ * Spreed WebRTC.
+ * Copyright (C) 2013-2014 struktur AG
+ *
+ * This file is part of Spreed WebRTC.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import "testing"
+
+func TestRateLimiterAllowsUpToCapacityThenDrops(t *testing.T) {
+	l := NewRateLimiter(RateLimitConfig{GlobalPerSecond: 2})
+
+	if !l.Allow("session-1", "Chat") {
+		t.Fatalf("first message should be allowed")
+	}
+	if !l.Allow("session-1", "Chat") {
+		t.Fatalf("second message should be allowed, capacity is 2")
+	}
+	if l.Allow("session-1", "Chat") {
+		t.Fatalf("third message should be dropped, bucket is exhausted")
+	}
+
+	stats := l.Stats("session-1")
+	if stats["Chat"].Dropped != 1 {
+		t.Errorf("Dropped = %d, want 1", stats["Chat"].Dropped)
+	}
+}
+
+func TestRateLimiterPerMessageTypeOverridesGlobal(t *testing.T) {
+	l := NewRateLimiter(RateLimitConfig{
+		GlobalPerSecond: 1,
+		PerMessageType:  map[string]float64{"Status": 5},
+	})
+
+	for i := 0; i < 5; i++ {
+		if !l.Allow("session-1", "Status") {
+			t.Fatalf("Status message %d should be allowed by its own 5/s override", i)
+		}
+	}
+	if l.Allow("session-1", "Status") {
+		t.Fatalf("6th Status message should be dropped, Status bucket capacity is 5")
+	}
+
+	if !l.Allow("session-1", "Chat") {
+		t.Fatalf("Chat message should still be allowed under the global rate")
+	}
+}
+
+func TestRateLimiterReleaseForgetsSession(t *testing.T) {
+	l := NewRateLimiter(RateLimitConfig{GlobalPerSecond: 1})
+
+	l.Allow("session-1", "Chat")
+	l.Allow("session-1", "Chat")
+	l.Release("session-1")
+
+	if stats := l.Stats("session-1"); len(stats) != 0 {
+		t.Errorf("Stats after Release = %+v, want empty", stats)
+	}
+	if !l.Allow("session-1", "Chat") {
+		t.Fatalf("message right after Release should be allowed, bucket was reset")
+	}
+}
@@ -0,0 +1,167 @@
+/*
+ * Spreed WebRTC.
+ * Copyright (C) 2013-2014 struktur AG
+ *
+ * This file is part of Spreed WebRTC.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// RoomManager tracks which sessions are members of which room and handles
+// joining, leaving and broadcasting to a room's members. ChannellingAPI
+// depends on this interface, not *roomManager directly, so tests can
+// substitute a fake.
+type RoomManager interface {
+	CanJoinRoom(backendId, roomID string) bool
+	RoomUsers(session *Session) []*DataSession
+	JoinRoom(session *Session, sender Sender)
+	LeaveRoom(session *Session)
+	Broadcast(session *Session, msg interface{})
+}
+
+// roomManager is the real RoomManager. Broadcast delegates to the Hub's
+// BroadcastRoom instead of iterating clients itself, so every room message
+// gets cross-node cluster fan-out and per-session rate limiting uniformly,
+// whether or not clustering is configured.
+type roomManager struct {
+	hub      Hub
+	backends *BackendManager
+	maxUsers int
+
+	mutex   sync.RWMutex
+	members map[string]map[string]bool
+}
+
+// NewRoomManager creates a RoomManager backed by hub. backends namespaces
+// room membership per backend (via BackendManager.RoomKey) so that the same
+// room id on two different backends never share members, capacity or
+// broadcasts; it may be nil when backends are not configured. maxUsers caps
+// the number of sessions allowed in a single room; zero or negative falls
+// back to maxUsersLength.
+func NewRoomManager(hub Hub, backends *BackendManager, maxUsers int) RoomManager {
+	if maxUsers <= 0 {
+		maxUsers = maxUsersLength
+	}
+	return &roomManager{
+		hub:      hub,
+		backends: backends,
+		maxUsers: maxUsers,
+		members:  make(map[string]map[string]bool),
+	}
+}
+
+// key namespaces roomId by backendId so that two backends sharing a room id
+// never share a members entry.
+func (rm *roomManager) key(backendId, roomId string) string {
+	return rm.backends.RoomKey(backendId, roomId)
+}
+
+func (rm *roomManager) CanJoinRoom(backendId, roomID string) bool {
+	rm.mutex.RLock()
+	defer rm.mutex.RUnlock()
+	return len(rm.members[rm.key(backendId, roomID)]) < rm.maxUsers
+}
+
+// JoinRoom adds session to its room and, once the room id is known, makes
+// sure this node is subscribed to that room's cluster subject. Doing this
+// here rather than on connect matters: session.Roomid is always empty when
+// a session first connects, so subscribing there would never subscribe to
+// anything.
+func (rm *roomManager) JoinRoom(session *Session, _ Sender) {
+	key := rm.key(session.Backend(), session.Roomid)
+
+	rm.mutex.Lock()
+	room, ok := rm.members[key]
+	if !ok {
+		room = make(map[string]bool)
+		rm.members[key] = room
+	}
+	room[session.Id] = true
+	rm.mutex.Unlock()
+
+	rm.hub.EnsureClusterRoomSubscribed(session.Roomid, session.Backend())
+}
+
+func (rm *roomManager) LeaveRoom(session *Session) {
+	key := rm.key(session.Backend(), session.Roomid)
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	room, ok := rm.members[key]
+	if !ok {
+		return
+	}
+	delete(room, session.Id)
+	if len(room) == 0 {
+		delete(rm.members, key)
+	}
+}
+
+func (rm *roomManager) RoomUsers(session *Session) []*DataSession {
+	key := rm.key(session.Backend(), session.Roomid)
+
+	rm.mutex.RLock()
+	ids := make([]string, 0, len(rm.members[key]))
+	for id := range rm.members[key] {
+		if id != session.Id {
+			ids = append(ids, id)
+		}
+	}
+	rm.mutex.RUnlock()
+
+	users := make([]*DataSession, 0, len(ids))
+	for _, id := range ids {
+		if peer, ok := rm.hub.GetSession(id); ok {
+			users = append(users, peer.Data())
+		}
+	}
+	return users
+}
+
+// Broadcast is the real counterpart the chunk0-1/chunk0-6 requests refer
+// to: it hands off to the Hub's BroadcastRoom so a room message fans out
+// to this node's local members, publishes to the room's cluster subject
+// for peer nodes, and is throttled by the per-session token-bucket
+// limiter, all in one place instead of each caller reimplementing it.
+func (rm *roomManager) Broadcast(session *Session, msg interface{}) {
+	rm.hub.BroadcastRoom(session, session.Roomid, wireType(msg), msg)
+}
+
+// wireType maps a concrete Data* broadcast payload to the wire type string
+// used by DataIncoming.Type and [ratelimit].per_message_type ("Chat",
+// "Status", "Bye", ...). Anything not listed falls back to its Go type
+// name so it still lands in its own rate limit bucket instead of silently
+// bypassing the limiter.
+func wireType(msg interface{}) string {
+	switch msg.(type) {
+	case *DataChat:
+		return "Chat"
+	case *DataStatus:
+		return "Status"
+	case *DataBye:
+		return "Bye"
+	case *DataSession:
+		return "Session"
+	default:
+		return fmt.Sprintf("%T", msg)
+	}
+}
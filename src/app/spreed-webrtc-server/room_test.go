@@ -0,0 +1,87 @@
+/*
+ * Spreed WebRTC.
+ * Copyright (C) 2013-2014 struktur AG
+ *
+ * This file is part of Spreed WebRTC.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import "testing"
+
+func newTestRoomManager(maxUsers int) *roomManager {
+	hub := NewHub(&Config{}, nil, nil, nil, nil, nil, nil, nil, nil, nil, RateLimitConfig{}).(*hub)
+	backends := NewBackendManager(nil)
+	return NewRoomManager(hub, backends, maxUsers).(*roomManager)
+}
+
+func TestRoomManagerJoinAndLeaveRoom(t *testing.T) {
+	rm := newTestRoomManager(0)
+	alice := &Session{Id: "alice", Roomid: "lobby"}
+	bob := &Session{Id: "bob", Roomid: "lobby"}
+
+	rm.JoinRoom(alice, nil)
+	rm.JoinRoom(bob, nil)
+
+	if !rm.CanJoinRoom("", "lobby") {
+		t.Errorf("CanJoinRoom(lobby) = false with no configured limit, want true")
+	}
+
+	key := rm.key("", "lobby")
+	rm.LeaveRoom(alice)
+	if _, stillThere := rm.members[key]["alice"]; stillThere {
+		t.Errorf("alice should have left lobby")
+	}
+	if _, stillThere := rm.members[key]["bob"]; !stillThere {
+		t.Errorf("bob should still be in lobby")
+	}
+
+	rm.LeaveRoom(bob)
+	if _, ok := rm.members[key]; ok {
+		t.Errorf("lobby should have been cleaned up once empty")
+	}
+}
+
+func TestRoomManagerCanJoinRoomRespectsMaxUsers(t *testing.T) {
+	rm := newTestRoomManager(1)
+	rm.JoinRoom(&Session{Id: "alice", Roomid: "lobby"}, nil)
+
+	if rm.CanJoinRoom("", "lobby") {
+		t.Errorf("CanJoinRoom(lobby) = true at capacity, want false")
+	}
+	if !rm.CanJoinRoom("", "other-room") {
+		t.Errorf("CanJoinRoom(other-room) = false, want true for an unrelated empty room")
+	}
+}
+
+func TestWireTypeMapsKnownDataTypesToTheirWireName(t *testing.T) {
+	tests := []struct {
+		msg  interface{}
+		want string
+	}{
+		{&DataChat{}, "Chat"},
+		{&DataStatus{}, "Status"},
+		{&DataBye{}, "Bye"},
+		{&DataSession{}, "Session"},
+		{"unexpected", "string"},
+	}
+	for _, tt := range tests {
+		if got := wireType(tt.msg); got != tt.want {
+			t.Errorf("wireType(%T) = %q, want %q", tt.msg, got, tt.want)
+		}
+	}
+}
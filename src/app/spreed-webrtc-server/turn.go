@@ -0,0 +1,116 @@
+/*
+ * Spreed WebRTC.
+ * Copyright (C) 2013-2014 struktur AG
+ *
+ * This file is part of Spreed WebRTC.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"time"
+)
+
+// TurnAlgorithm selects the HMAC hash used for the updated coturn REST
+// auth profile, which allows SHA-256 and SHA-512 in addition to the
+// original SHA-1 from draft-uberti-behave-turn-rest-00.
+type TurnAlgorithm string
+
+const (
+	TurnAlgorithmSHA1   TurnAlgorithm = "sha1"
+	TurnAlgorithmSHA256 TurnAlgorithm = "sha256"
+	TurnAlgorithmSHA512 TurnAlgorithm = "sha512"
+)
+
+func (a TurnAlgorithm) hasher() func() hash.Hash {
+	switch a {
+	case TurnAlgorithmSHA256:
+		return sha256.New
+	case TurnAlgorithmSHA512:
+		return sha512.New
+	default:
+		return sha1.New
+	}
+}
+
+// TurnRealmConfig describes one entry of the [turn] config section. Each
+// realm has its own shared secret, HMAC algorithm, URI list and TTL, so
+// operators can run geographically distributed TURN servers and let the
+// client race ICE gathering across all of them.
+type TurnRealmConfig struct {
+	Name      string
+	Algorithm TurnAlgorithm
+	Secret    []byte
+	URIs      []string
+	TTL       int32
+	// Quota is the optional per-user bandwidth/session quota sent to the
+	// client with this realm's credentials in DataTurnRealm, zero meaning
+	// unlimited. The single DataTurn returned by CreateTurnData carries no
+	// quota.
+	Quota int32
+	// BackendId restricts this realm to sessions of that backend. Empty
+	// means the realm is shared by every backend (or by single-tenant
+	// setups that configure no backends at all).
+	BackendId string
+}
+
+// DataTurnRealm is the per-realm TURN credential set sent to the client so
+// it can race ICE gathering across every configured realm.
+type DataTurnRealm struct {
+	Realm    string   `json:"realm,omitempty"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	TTL      int32    `json:"ttl"`
+	URIs     []string `json:"uris"`
+	Quota    int32    `json:"quota,omitempty"`
+}
+
+// ttlOrDefault returns realm.TTL, falling back to the legacy turnTTL
+// constant when a realm built from an incomplete [turn] section left TTL
+// at its zero value. Without this, such a realm would hand out credentials
+// that expire the instant they are issued.
+func (realm *TurnRealmConfig) ttlOrDefault() int32 {
+	if realm.TTL <= 0 {
+		return turnTTL
+	}
+	return realm.TTL
+}
+
+// createTurnCredentials computes the username/password pair for realm and
+// session as per draft-uberti-behave-turn-rest-00, using realm's configured
+// HMAC algorithm instead of always hard-coding SHA-1.
+func createTurnCredentials(realm *TurnRealmConfig, sessionId string) (user, password string) {
+	digest := sha256.New()
+	digest.Write([]byte(sessionId))
+	id := base64.StdEncoding.EncodeToString(digest.Sum(nil))
+
+	expiration := int32(time.Now().Unix()) + realm.ttlOrDefault()
+	user = fmt.Sprintf("%d:%s", expiration, id)
+
+	mac := hmac.New(realm.Algorithm.hasher(), realm.Secret)
+	mac.Write([]byte(user))
+	password = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	return
+}
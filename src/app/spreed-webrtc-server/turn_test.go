@@ -0,0 +1,110 @@
+/*
+ * Spreed WebRTC.
+ * Copyright (C) 2013-2014 struktur AG
+ *
+ * This file is part of Spreed WebRTC.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"reflect"
+	"testing"
+)
+
+func TestTurnAlgorithmHasher(t *testing.T) {
+	tests := []struct {
+		algorithm TurnAlgorithm
+		want      interface{}
+	}{
+		{TurnAlgorithmSHA1, sha1.New()},
+		{TurnAlgorithmSHA256, sha256.New()},
+		{TurnAlgorithmSHA512, sha512.New()},
+		{TurnAlgorithm("bogus"), sha1.New()},
+		{"", sha1.New()},
+	}
+	for _, tt := range tests {
+		got := tt.algorithm.hasher()()
+		if reflect.TypeOf(got) != reflect.TypeOf(tt.want) {
+			t.Errorf("hasher() for %q = %T, want %T", tt.algorithm, got, tt.want)
+		}
+	}
+}
+
+func TestCreateTurnCredentialsUsesConfiguredAlgorithm(t *testing.T) {
+	sha1Realm := &TurnRealmConfig{Name: "sha1", Algorithm: TurnAlgorithmSHA1, Secret: []byte("secret"), TTL: 3600}
+	sha256Realm := &TurnRealmConfig{Name: "sha256", Algorithm: TurnAlgorithmSHA256, Secret: []byte("secret"), TTL: 3600}
+
+	_, sha1Password := createTurnCredentials(sha1Realm, "session-1")
+	_, sha256Password := createTurnCredentials(sha256Realm, "session-1")
+
+	if sha1Password == sha256Password {
+		t.Fatalf("expected different passwords for different HMAC algorithms, got the same value")
+	}
+
+	user1, _ := createTurnCredentials(sha1Realm, "session-1")
+	user2, _ := createTurnCredentials(sha1Realm, "session-1")
+	if user1 != user2 {
+		t.Errorf("expected the same user for repeated calls within the same second, got %q and %q", user1, user2)
+	}
+}
+
+func TestCreateTurnCredentialsFallsBackToDefaultTTLWhenUnset(t *testing.T) {
+	realm := &TurnRealmConfig{Name: "unset-ttl", Algorithm: TurnAlgorithmSHA1, Secret: []byte("secret")}
+
+	if got := realm.ttlOrDefault(); got != turnTTL {
+		t.Fatalf("ttlOrDefault() with TTL unset = %d, want %d", got, turnTTL)
+	}
+
+	withDefault := &TurnRealmConfig{Name: "with-default", Algorithm: TurnAlgorithmSHA1, Secret: []byte("secret"), TTL: turnTTL}
+	_, password := createTurnCredentials(realm, "session-1")
+	_, passwordWithDefault := createTurnCredentials(withDefault, "session-1")
+	if password != passwordWithDefault {
+		t.Errorf("credentials with TTL unset should match credentials with TTL explicitly set to the default")
+	}
+}
+
+func newHubWithRealms(realms []*TurnRealmConfig) *hub {
+	h := NewHub(&Config{}, nil, nil, nil, nil, nil, nil, nil, nil, realms, RateLimitConfig{}).(*hub)
+	return h
+}
+
+func TestRealmsForBackendDoesNotLeakAcrossBackends(t *testing.T) {
+	shared := &TurnRealmConfig{Name: "shared", Secret: []byte("shared-secret"), TTL: 60}
+	tenantA := &TurnRealmConfig{Name: "a", BackendId: "a", Secret: []byte("a-secret"), TTL: 60}
+	tenantB := &TurnRealmConfig{Name: "b", BackendId: "b", Secret: []byte("b-secret"), TTL: 60}
+	h := newHubWithRealms([]*TurnRealmConfig{shared, tenantA, tenantB})
+
+	realms := h.realmsForBackend("b")
+	if _, ok := realms["a"]; ok {
+		t.Fatalf("realmsForBackend(\"b\") leaked backend a's realm")
+	}
+	if realm, ok := realms["b"]; !ok || realm.Secret == nil {
+		t.Fatalf("realmsForBackend(\"b\") is missing its own realm")
+	}
+	if _, ok := realms["shared"]; !ok {
+		t.Fatalf("realmsForBackend(\"b\") is missing the shared realm")
+	}
+
+	realmsA := h.realmsForBackend("a")
+	if _, ok := realmsA["b"]; ok {
+		t.Fatalf("realmsForBackend(\"a\") leaked backend b's realm")
+	}
+}